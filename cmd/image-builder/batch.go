@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+
+	"github.com/osbuild/images/pkg/ostree"
+)
+
+// batchJob is a single job as described in a batch spec file. It mirrors
+// the flags accepted by the "manifest" and "build" commands so that a
+// spec file can express the same thing a single CLI invocation would.
+type batchJob struct {
+	Distro     string   `json:"distro" yaml:"distro"`
+	ImageType  string   `json:"image_type" yaml:"image_type"`
+	Arch       string   `json:"arch" yaml:"arch"`
+	Blueprint  string   `json:"blueprint,omitempty" yaml:"blueprint,omitempty"`
+	OstreeRef  string   `json:"ostree_ref,omitempty" yaml:"ostree_ref,omitempty"`
+	ExtraRepos []string `json:"extra_repos,omitempty" yaml:"extra_repos,omitempty"`
+	OutputDir  string   `json:"output_dir,omitempty" yaml:"output_dir,omitempty"`
+	UploadTo   string   `json:"upload_to,omitempty" yaml:"upload_to,omitempty"`
+}
+
+// batchSpec is the top-level "image-builder batch" spec file format.
+type batchSpec struct {
+	Jobs []batchJob `json:"jobs" yaml:"jobs"`
+}
+
+func loadBatchSpec(path string) (*batchSpec, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read batch spec: %w", err)
+	}
+
+	var spec batchSpec
+	switch filepath.Ext(path) {
+	case ".json":
+		if err := json.Unmarshal(buf, &spec); err != nil {
+			return nil, fmt.Errorf("cannot parse batch spec: %w", err)
+		}
+	default:
+		if err := yaml.Unmarshal(buf, &spec); err != nil {
+			return nil, fmt.Errorf("cannot parse batch spec: %w", err)
+		}
+	}
+	if len(spec.Jobs) == 0 {
+		return nil, fmt.Errorf("batch spec %q has no jobs", path)
+	}
+	for i, job := range spec.Jobs {
+		if job.UploadTo == "" {
+			continue
+		}
+		entry, ok := uploaderRegistry[job.ImageType]
+		if !ok {
+			return nil, fmt.Errorf("job %d (%s/%s/%s): image type %q has no uploader, cannot upload_to %q", i, job.Distro, job.ImageType, job.Arch, job.ImageType, job.UploadTo)
+		}
+		if entry.provider != job.UploadTo {
+			return nil, fmt.Errorf("job %d (%s/%s/%s): image type %q uploads via %q, not %q", i, job.Distro, job.ImageType, job.Arch, job.ImageType, entry.provider, job.UploadTo)
+		}
+	}
+	return &spec, nil
+}
+
+// batchJobReport is the per-job entry in the batch summary report.
+type batchJobReport struct {
+	Distro       string   `json:"distro"`
+	ImageType    string   `json:"image_type"`
+	Arch         string   `json:"arch"`
+	Status       string   `json:"status"` // "ok" or "failed"
+	Error        string   `json:"error,omitempty"`
+	Duration     string   `json:"duration"`
+	ManifestSHA  string   `json:"manifest_sha256,omitempty"`
+	Artifacts    []string `json:"artifacts,omitempty"`
+	CloudImageID string   `json:"cloud_image_id,omitempty"`
+}
+
+// batchReport is the summary written to <output-dir>/batch-report.json
+// once all jobs have finished (or failed).
+type batchReport struct {
+	Jobs []batchJobReport `json:"jobs"`
+}
+
+func runBatchJob(pbar *muxProgress, cmd *cobra.Command, job batchJob, repoOpts *repoOptions, cacheDir string) batchJobReport {
+	start := time.Now()
+	report := batchJobReport{
+		Distro:    job.Distro,
+		ImageType: job.ImageType,
+		Arch:      job.Arch,
+	}
+
+	fail := func(err error) batchJobReport {
+		report.Status = "failed"
+		report.Error = err.Error()
+		report.Duration = time.Since(start).String()
+		return report
+	}
+
+	jobRepoOpts := &repoOptions{
+		DataDir:    repoOpts.DataDir,
+		ExtraRepos: append(append([]string{}, repoOpts.ExtraRepos...), job.ExtraRepos...),
+		ForceRepos: repoOpts.ForceRepos,
+	}
+	img, err := getOneImage(job.Distro, job.ImageType, job.Arch, jobRepoOpts)
+	if err != nil {
+		return fail(err)
+	}
+
+	var ostreeOpts *ostree.ImageOptions
+	if job.OstreeRef != "" {
+		ostreeOpts = &ostree.ImageOptions{ImageRef: job.OstreeRef}
+	}
+
+	var mf bytes.Buffer
+	manifestOpts := &manifestOptions{
+		BlueprintPath: job.Blueprint,
+		Ostree:        ostreeOpts,
+	}
+	if err := generateManifest(jobRepoOpts.DataDir, jobRepoOpts.ExtraRepos, img, &mf, manifestOpts); err != nil {
+		return fail(err)
+	}
+	digest := sha256.Sum256(mf.Bytes())
+	report.ManifestSHA = hex.EncodeToString(digest[:])
+
+	outputDir := job.OutputDir
+	if outputDir == "" {
+		outputDir = outputNameFor(img)
+	}
+	buildOpts := &buildOptions{
+		OutputDir: outputDir,
+		StoreDir:  cacheDir,
+	}
+	label := fmt.Sprintf("Building %s/%s/%s", job.Distro, job.ImageType, job.Arch)
+	err = pbar.withJob(label, func(pbar progressBarT) error {
+		return buildImage(pbar, img, mf.Bytes(), buildOpts)
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	artifactPath := filepath.Join(outputDir, img.ImgType.Name(), img.ImgType.Filename())
+	report.Artifacts = []string{artifactPath}
+
+	if job.UploadTo != "" {
+		uploader, err := uploaderFor(cmd, img.ImgType.Name())
+		if err != nil {
+			return fail(fmt.Errorf("upload to %q: %w", job.UploadTo, err))
+		}
+		uploadLabel := fmt.Sprintf("Uploading %s/%s/%s", job.Distro, job.ImageType, job.Arch)
+		err = pbar.withJob(uploadLabel, func(pbar progressBarT) error {
+			if err := uploaderCheckWithProgress(pbar, uploader); err != nil {
+				return err
+			}
+			id, err := uploader.Upload(artifactPath, job.Arch)
+			if err != nil {
+				return err
+			}
+			report.CloudImageID = id
+			return nil
+		})
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	report.Status = "ok"
+	report.Duration = time.Since(start).String()
+	return report
+}
+
+func cmdBatch(cmd *cobra.Command, args []string) error {
+	specPath := args[0]
+	jobs, err := cmd.Flags().GetInt("jobs")
+	if err != nil {
+		return err
+	}
+	cacheDir, err := cmd.Flags().GetString("cache")
+	if err != nil {
+		return err
+	}
+	outputDir, err := cmd.Flags().GetString("output-dir")
+	if err != nil {
+		return err
+	}
+	dataDir, err := cmd.Flags().GetString("datadir")
+	if err != nil {
+		return err
+	}
+	extraRepos, err := cmd.Flags().GetStringArray("extra-repo")
+	if err != nil {
+		return err
+	}
+	forceRepos, err := cmd.Flags().GetStringArray("force-repo")
+	if err != nil {
+		return err
+	}
+	if outputDir == "" {
+		outputDir = "."
+	}
+	if jobs <= 0 {
+		jobs = runtime.GOMAXPROCS(0)
+	}
+
+	spec, err := loadBatchSpec(specPath)
+	if err != nil {
+		return err
+	}
+
+	pbarInner, err := progressFromCmd(cmd)
+	if err != nil {
+		return err
+	}
+	pbarInner.Start()
+	defer pbarInner.Stop()
+	pbar := newMuxProgress(pbarInner)
+
+	repoOpts := &repoOptions{
+		DataDir:    dataDir,
+		ExtraRepos: extraRepos,
+		ForceRepos: forceRepos,
+	}
+
+	reports := make([]batchJobReport, len(spec.Jobs))
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i, job := range spec.Jobs {
+		wg.Add(1)
+		go func(i int, job batchJob) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			reports[i] = runBatchJob(pbar, cmd, job, repoOpts, cacheDir)
+		}(i, job)
+	}
+	wg.Wait()
+
+	summary := batchReport{Jobs: reports}
+	buf, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	reportPath := filepath.Join(outputDir, "batch-report.json")
+	if err := os.WriteFile(reportPath, buf, 0o644); err != nil {
+		return fmt.Errorf("cannot write batch report: %w", err)
+	}
+	fmt.Fprintf(osStdout, "wrote batch report to %s\n", reportPath)
+
+	for _, r := range reports {
+		if r.Status == "failed" {
+			return fmt.Errorf("one or more batch jobs failed, see %s", reportPath)
+		}
+	}
+	return nil
+}
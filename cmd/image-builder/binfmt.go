@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// EmulatedArch describes a foreign architecture that will be built via a
+// binfmt_misc registered interpreter (e.g. qemu-user-static) instead of
+// natively.
+type EmulatedArch struct {
+	// Arch is the target architecture, e.g. "aarch64".
+	Arch string
+	// InterpreterPath is the absolute path of the qemu-user static
+	// interpreter binary that binfmt_misc will invoke.
+	InterpreterPath string
+}
+
+// BinfmtInterpreterMissingError is returned when a build for a foreign
+// architecture is requested but no matching binfmt_misc handler is
+// registered on the host.
+type BinfmtInterpreterMissingError struct {
+	Arch string
+}
+
+func (e *BinfmtInterpreterMissingError) Error() string {
+	return fmt.Sprintf("cannot build for arch %q: no binfmt_misc interpreter registered (is qemu-user-static installed and binfmt_misc mounted?)", e.Arch)
+}
+
+// probeBinfmtInterpreter looks for a registered binfmt_misc handler for
+// archStr (e.g. "aarch64") under /proc/sys/fs/binfmt_misc and, if found,
+// returns the path to its interpreter binary.
+func probeBinfmtInterpreter(archStr string) (*EmulatedArch, error) {
+	registration := filepath.Join("/proc/sys/fs/binfmt_misc", "qemu-"+archStr)
+
+	buf, err := os.ReadFile(registration)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &BinfmtInterpreterMissingError{Arch: archStr}
+		}
+		return nil, fmt.Errorf("cannot read binfmt_misc registration for %q: %w", archStr, err)
+	}
+
+	interp, err := parseBinfmtInterpreterPath(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", registration, err)
+	}
+	return &EmulatedArch{Arch: archStr, InterpreterPath: interp}, nil
+}
+
+// parseBinfmtInterpreterPath extracts the interpreter path from the
+// contents of a /proc/sys/fs/binfmt_misc/<name> registration file, e.g.
+// the "interpreter /usr/bin/qemu-aarch64-static" line.
+func parseBinfmtInterpreterPath(registration []byte) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(registration))
+	for scanner.Scan() {
+		if interp, ok := strings.CutPrefix(scanner.Text(), "interpreter "); ok {
+			return interp, nil
+		}
+	}
+	return "", fmt.Errorf("no interpreter line found")
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestParseBinfmtInterpreterPath(t *testing.T) {
+	registration := []byte(`enabled
+interpreter /usr/bin/qemu-aarch64-static
+flags: OC
+offset 0
+magic 7f454c460201010000000000000000000200003e00
+mask ffffffffffffff00fffffffffffffffffeffffff
+`)
+
+	interp, err := parseBinfmtInterpreterPath(registration)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if interp != "/usr/bin/qemu-aarch64-static" {
+		t.Fatalf("got interpreter %q, want %q", interp, "/usr/bin/qemu-aarch64-static")
+	}
+}
+
+func TestParseBinfmtInterpreterPathMissing(t *testing.T) {
+	registration := []byte(`enabled
+flags: OC
+offset 0
+`)
+
+	if _, err := parseBinfmtInterpreterPath(registration); err == nil {
+		t.Fatal("expected an error when no interpreter line is present")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// buildManifestFilename is the name buildImage writes the osbuild
+// manifest under in OutputDir when buildOptions.WriteManifest is set.
+const buildManifestFilename = "manifest.json"
+
+// buildCacheKey derives a content-addressed cache key for a build from
+// its generated manifest. The manifest already embeds the resolved RPM
+// NEVRAs and ostree refs used to build it, so hashing it is sufficient
+// to detect "nothing relevant changed" without re-deriving those sets
+// separately.
+func buildCacheKey(manifestBytes []byte) string {
+	digest := sha256.Sum256(manifestBytes)
+	return hex.EncodeToString(digest[:])
+}
+
+// buildCacheArtifactsDir returns the directory under cacheDir that holds
+// (or would hold) the cached artifacts for the given build cache key.
+func buildCacheArtifactsDir(cacheDir, key string) string {
+	return filepath.Join(cacheDir, "artifacts", key)
+}
+
+// buildCacheCompleteMarker is written last by storeInBuildCache, once
+// every artifact has been linked/copied into place. Its presence is what
+// lookupBuildCache treats as "this cache entry is usable" so a build
+// interrupted mid-store (OOM, disk full, SIGKILL) can't be mistaken for
+// a valid cache hit.
+const buildCacheCompleteMarker = ".complete"
+
+// lookupBuildCache reports whether a complete set of cached artifacts
+// already exists for key.
+func lookupBuildCache(cacheDir, key string) (string, bool) {
+	dir := buildCacheArtifactsDir(cacheDir, key)
+	if _, err := os.Stat(filepath.Join(dir, buildCacheCompleteMarker)); err != nil {
+		return "", false
+	}
+	return dir, true
+}
+
+// populateFromBuildCache hardlinks (falling back to copying across
+// filesystems) every file under cachedDir into outputDir, recreating the
+// same relative directory structure osbuild would have produced.
+func populateFromBuildCache(cachedDir, outputDir string) error {
+	return filepath.Walk(cachedDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(cachedDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == buildCacheCompleteMarker {
+			return nil
+		}
+		dst := filepath.Join(outputDir, rel)
+		if info.IsDir() {
+			return os.MkdirAll(dst, 0o755)
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		if err := os.Link(path, dst); err != nil {
+			return copyFile(path, dst)
+		}
+		return nil
+	})
+}
+
+// storeInBuildCache copies the artifacts just built in outputDir into the
+// content-addressed cache under key, so a future build with an identical
+// manifest can be served from cache instead of re-invoking osbuild. The
+// optional "manifest.json" written by --with-manifest is deliberately
+// left out of the cache: whether it's written is a per-invocation choice
+// (--with-manifest), not a property of the build artifacts themselves.
+func storeInBuildCache(outputDir, cacheDir, key string) error {
+	dst := buildCacheArtifactsDir(cacheDir, key)
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	err := filepath.Walk(outputDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(outputDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == buildManifestFilename {
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0o755)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		if err := os.Link(path, target); err != nil {
+			return copyFile(path, target)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dst, buildCacheCompleteMarker), nil, 0o644)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// buildPlan is what "build --dry-run" / "plan" print instead of actually
+// invoking osbuild.
+type buildPlan struct {
+	ManifestDigest string   `json:"manifest_digest"`
+	CacheHit       bool     `json:"cache_hit"`
+	CacheKey       string   `json:"cache_key"`
+	Stages         []string `json:"stages"`
+	Packages       []string `json:"packages"`
+}
+
+// osbuildManifestStages extracts the "type" of every stage in every
+// pipeline of a generated osbuild manifest, in pipeline order, for
+// display in "build --dry-run"/"plan" output. It intentionally only
+// looks at the fields it needs rather than unmarshalling into
+// osbuild.Manifest, since the CLI has no other use for the full typed
+// manifest at this point.
+func osbuildManifestStages(manifestBytes []byte) ([]string, error) {
+	var doc struct {
+		Pipelines []struct {
+			Name   string `json:"name"`
+			Stages []struct {
+				Type string `json:"type"`
+			} `json:"stages"`
+		} `json:"pipelines"`
+	}
+	if err := json.Unmarshal(manifestBytes, &doc); err != nil {
+		return nil, fmt.Errorf("cannot parse manifest: %w", err)
+	}
+
+	var stages []string
+	for _, p := range doc.Pipelines {
+		for _, s := range p.Stages {
+			stages = append(stages, fmt.Sprintf("%s:%s", p.Name, s.Type))
+		}
+	}
+	return stages, nil
+}
+
+// osbuildManifestPackages extracts the resolved package NEVRAs embedded in
+// the "org.osbuild.rpm" stage(s) of a generated osbuild manifest, for
+// display in "build --dry-run"/"plan" output. Like osbuildManifestStages,
+// it only looks at the fields it needs rather than unmarshalling into
+// osbuild.Manifest.
+func osbuildManifestPackages(manifestBytes []byte) ([]string, error) {
+	var doc struct {
+		Pipelines []struct {
+			Stages []struct {
+				Type   string `json:"type"`
+				Inputs struct {
+					Packages struct {
+						References map[string]struct {
+							Metadata struct {
+								RPM struct {
+									Name    string `json:"name"`
+									Epoch   string `json:"epoch"`
+									Version string `json:"version"`
+									Release string `json:"release"`
+									Arch    string `json:"arch"`
+								} `json:"rpm"`
+							} `json:"metadata"`
+						} `json:"references"`
+					} `json:"packages"`
+				} `json:"inputs"`
+			} `json:"stages"`
+		} `json:"pipelines"`
+	}
+	if err := json.Unmarshal(manifestBytes, &doc); err != nil {
+		return nil, fmt.Errorf("cannot parse manifest: %w", err)
+	}
+
+	var nevras []string
+	for _, p := range doc.Pipelines {
+		for _, s := range p.Stages {
+			if s.Type != "org.osbuild.rpm" {
+				continue
+			}
+			for _, ref := range s.Inputs.Packages.References {
+				rpm := ref.Metadata.RPM
+				if rpm.Name == "" {
+					continue
+				}
+				nevras = append(nevras, nevra(rpm.Name, rpm.Epoch, rpm.Version, rpm.Release, rpm.Arch))
+			}
+		}
+	}
+	sort.Strings(nevras)
+	return nevras, nil
+}
+
+// nevra formats a package's name/epoch/version/release/arch as the
+// conventional "N-E:V-R.A" string, omitting the epoch when it's empty or
+// "0" as rpm itself does.
+func nevra(name, epoch, version, release, arch string) string {
+	if epoch == "" || epoch == "0" {
+		return fmt.Sprintf("%s-%s-%s.%s", name, version, release, arch)
+	}
+	return fmt.Sprintf("%s-%s:%s-%s.%s", name, epoch, version, release, arch)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildCacheKeyDeterministic(t *testing.T) {
+	manifest := []byte(`{"pipelines":[]}`)
+	if buildCacheKey(manifest) != buildCacheKey(manifest) {
+		t.Fatal("buildCacheKey is not deterministic for the same input")
+	}
+	if buildCacheKey(manifest) == buildCacheKey([]byte(`{"pipelines":[{}]}`)) {
+		t.Fatal("buildCacheKey returned the same key for different manifests")
+	}
+}
+
+func TestLookupBuildCacheRequiresCompleteMarker(t *testing.T) {
+	cacheDir := t.TempDir()
+	key := "abc123"
+
+	if _, ok := lookupBuildCache(cacheDir, key); ok {
+		t.Fatal("expected no cache hit before anything was stored")
+	}
+
+	artifactsDir := buildCacheArtifactsDir(cacheDir, key)
+	if err := os.MkdirAll(artifactsDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(artifactsDir, "disk.qcow2"), []byte("not a real image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lookupBuildCache(cacheDir, key); ok {
+		t.Fatal("expected no cache hit for a directory missing its .complete marker")
+	}
+
+	if err := os.WriteFile(filepath.Join(artifactsDir, buildCacheCompleteMarker), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dir, ok := lookupBuildCache(cacheDir, key)
+	if !ok {
+		t.Fatal("expected a cache hit once the .complete marker is present")
+	}
+	if dir != artifactsDir {
+		t.Fatalf("got cache dir %q, want %q", dir, artifactsDir)
+	}
+}
+
+func TestStoreAndPopulateBuildCache(t *testing.T) {
+	outputDir := t.TempDir()
+	cacheDir := t.TempDir()
+	key := "def456"
+
+	if err := os.MkdirAll(filepath.Join(outputDir, "qcow2"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, "qcow2", "disk.qcow2"), []byte("image bytes"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, buildManifestFilename), []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storeInBuildCache(outputDir, cacheDir, key); err != nil {
+		t.Fatalf("storeInBuildCache: %v", err)
+	}
+
+	artifactsDir := buildCacheArtifactsDir(cacheDir, key)
+	if _, err := os.Stat(filepath.Join(artifactsDir, buildManifestFilename)); !os.IsNotExist(err) {
+		t.Fatalf("expected %q to be excluded from the build cache", buildManifestFilename)
+	}
+	if _, err := os.Stat(filepath.Join(artifactsDir, buildCacheCompleteMarker)); err != nil {
+		t.Fatalf("expected .complete marker to be written: %v", err)
+	}
+
+	restoreDir := t.TempDir()
+	if err := populateFromBuildCache(artifactsDir, restoreDir); err != nil {
+		t.Fatalf("populateFromBuildCache: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(restoreDir, "qcow2", "disk.qcow2"))
+	if err != nil {
+		t.Fatalf("expected disk.qcow2 to be restored: %v", err)
+	}
+	if string(got) != "image bytes" {
+		t.Fatalf("got restored content %q, want %q", got, "image bytes")
+	}
+	if _, err := os.Stat(filepath.Join(restoreDir, buildCacheCompleteMarker)); !os.IsNotExist(err) {
+		t.Fatal("expected .complete marker not to be restored into outputDir")
+	}
+}
+
+func TestOsbuildManifestStages(t *testing.T) {
+	manifest := []byte(`{
+		"pipelines": [
+			{"name": "build", "stages": [{"type": "org.osbuild.rpm"}, {"type": "org.osbuild.selinux"}]},
+			{"name": "image", "stages": [{"type": "org.osbuild.qemu"}]}
+		]
+	}`)
+
+	stages, err := osbuildManifestStages(manifest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"build:org.osbuild.rpm", "build:org.osbuild.selinux", "image:org.osbuild.qemu"}
+	if len(stages) != len(want) {
+		t.Fatalf("got %v, want %v", stages, want)
+	}
+	for i := range want {
+		if stages[i] != want[i] {
+			t.Fatalf("got %v, want %v", stages, want)
+		}
+	}
+}
+
+func TestOsbuildManifestPackages(t *testing.T) {
+	manifest := []byte(`{
+		"pipelines": [
+			{"name": "build", "stages": [{
+				"type": "org.osbuild.rpm",
+				"inputs": {"packages": {"references": {
+					"sha256:aaaa": {"metadata": {"rpm": {"name": "bash", "epoch": "", "version": "5.2", "release": "1.fc40", "arch": "x86_64"}}},
+					"sha256:bbbb": {"metadata": {"rpm": {"name": "glibc", "epoch": "2", "version": "2.39", "release": "2.fc40", "arch": "x86_64"}}}
+				}}}
+			}]}
+		]
+	}`)
+
+	packages, err := osbuildManifestPackages(manifest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"bash-5.2-1.fc40.x86_64", "glibc-2:2.39-2.fc40.x86_64"}
+	if len(packages) != len(want) {
+		t.Fatalf("got %v, want %v", packages, want)
+	}
+	for i := range want {
+		if packages[i] != want[i] {
+			t.Fatalf("got %v, want %v", packages, want)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -169,6 +170,13 @@ func cmdManifestWrapper(pbar progress.ProgressBar, cmd *cobra.Command, args []st
 	return img, err
 }
 
+// sbomPathFor returns the path generateManifest writes the --with-sbom
+// SPDX document to for img, mirroring the "<distro>-<type>-<arch>"
+// output directory convention used by outputNameFor.
+func sbomPathFor(img *imagefilter.Result, outputDir string) string {
+	return filepath.Join(outputDir, img.ImgType.Name(), img.ImgType.Filename()+".spdx.json")
+}
+
 func cmdManifest(cmd *cobra.Command, args []string) error {
 	pbar, err := progress.New("")
 	if err != nil {
@@ -207,6 +215,10 @@ func cmdBuild(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
 	pbar, err := progressFromCmd(cmd)
 	if err != nil {
 		return err
@@ -220,18 +232,55 @@ func cmdBuild(cmd *cobra.Command, args []string) error {
 		pbar.Stop()
 	}()
 
+	foreignArch, err := cmd.Flags().GetBool("foreign-arch")
+	if err != nil {
+		return err
+	}
+
+	var emulatedArch *EmulatedArch
 	var mf bytes.Buffer
 	// XXX: check env here, i.e. if user is root and osbuild is installed
 	res, err := cmdManifestWrapper(pbar, cmd, args, &mf, func(archStr string) error {
-		if archStr != arch.Current().String() {
-			return fmt.Errorf("cannot build for arch %q from %q", archStr, arch.Current().String())
+		if archStr == arch.Current().String() {
+			return nil
+		}
+		if !foreignArch {
+			return fmt.Errorf("cannot build for arch %q from %q (use --foreign-arch to build via binfmt/QEMU emulation)", archStr, arch.Current().String())
+		}
+		ea, err := probeBinfmtInterpreter(archStr)
+		if err != nil {
+			return err
 		}
+		emulatedArch = ea
 		return nil
 	})
 	if err != nil {
 		return err
 	}
 
+	cacheKey := buildCacheKey(mf.Bytes())
+	if dryRun {
+		_, cacheHit := lookupBuildCache(cacheDir, cacheKey)
+		stages, err := osbuildManifestStages(mf.Bytes())
+		if err != nil {
+			return err
+		}
+		packages, err := osbuildManifestPackages(mf.Bytes())
+		if err != nil {
+			return err
+		}
+		plan := buildPlan{
+			ManifestDigest: cacheKey,
+			CacheHit:       cacheHit,
+			CacheKey:       cacheKey,
+			Stages:         stages,
+			Packages:       packages,
+		}
+		enc := json.NewEncoder(osStdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plan)
+	}
+
 	var uploadUnsupported *UploadTypeUnsupportedError
 	var missingUploadConfig *MissingUploadConfigError
 	uploader, err := uploaderFor(cmd, res.ImgType.Name())
@@ -254,22 +303,73 @@ func cmdBuild(cmd *cobra.Command, args []string) error {
 	if outputDir == "" {
 		outputDir = outputNameFor(res)
 	}
-	buildOpts := &buildOptions{
-		OutputDir:     outputDir,
-		StoreDir:      cacheDir,
-		WriteManifest: withManifest,
+	if cachedDir, ok := lookupBuildCache(cacheDir, cacheKey); ok {
+		pbar.SetPulseMsgf("Reusing cached build artifacts")
+		if err := populateFromBuildCache(cachedDir, outputDir); err != nil {
+			return err
+		}
+		// manifest.json is never part of the cache (see storeInBuildCache),
+		// so --with-manifest is honored here rather than depending on
+		// whatever build originally populated this cache entry.
+		if withManifest {
+			if err := os.WriteFile(filepath.Join(outputDir, buildManifestFilename), mf.Bytes(), 0o644); err != nil {
+				return err
+			}
+		}
+	} else {
+		buildOpts := &buildOptions{
+			OutputDir:     outputDir,
+			StoreDir:      cacheDir,
+			WriteManifest: withManifest,
+			EmulatedArch:  emulatedArch,
+		}
+		pbar.SetPulseMsgf("Image building step")
+		if err := buildImage(pbar, res, mf.Bytes(), buildOpts); err != nil {
+			return err
+		}
+		// Caching is an optimization on top of a build that has already
+		// succeeded: a full, usable image is sitting in outputDir
+		// regardless of whether we manage to save it for next time, so a
+		// cache write failure (e.g. a read-only/full --cache filesystem)
+		// must not turn a successful build into a reported failure.
+		if err := storeInBuildCache(outputDir, cacheDir, cacheKey); err != nil {
+			fmt.Fprintf(osStderr, "warning: could not save build cache: %s\n", err)
+		}
 	}
-	pbar.SetPulseMsgf("Image building step")
-	if err := buildImage(pbar, res, mf.Bytes(), buildOpts); err != nil {
+
+	imagePath := filepath.Join(outputDir, res.ImgType.Name(), res.ImgType.Filename())
+
+	withSBOM, err := cmd.Flags().GetBool("with-sbom")
+	if err != nil {
+		return err
+	}
+	signSBOM, err := cmd.Flags().GetString("sign-sbom")
+	if err != nil {
 		return err
 	}
+	attestProvenance, err := cmd.Flags().GetBool("attest-provenance")
+	if err != nil {
+		return err
+	}
+	if withSBOM && signSBOM != "" {
+		if err := signSBOMAttestation(sbomPathFor(res, outputDir), imagePath, signSBOM); err != nil {
+			return err
+		}
+	}
+	if attestProvenance {
+		blueprintPath, err := cmd.Flags().GetString("blueprint")
+		if err != nil {
+			return err
+		}
+		if err := writeProvenanceAttestation(res, imagePath, cacheKey, blueprintPath); err != nil {
+			return err
+		}
+	}
 
 	if uploader != nil {
 		// XXX: integrate better into the progress, see bib
 		pbar.Stop()
-		imagePath := filepath.Join(outputDir, res.ImgType.Name(), res.ImgType.Filename())
-
-		if err := uploadImageWithProgress(uploader, imagePath); err != nil {
+		if err := uploadImageWithProgress(uploader, imagePath, res.Arch.Name()); err != nil {
 			return err
 		}
 	}
@@ -357,6 +457,8 @@ operating systems like Fedora, CentOS and RHEL with easy customizations support.
 	manifestCmd.Flags().String("ostree-url", "", `OSTREE url`)
 	manifestCmd.Flags().Bool("use-librepo", true, `use librepo to download packages (disable if you use old versions of osbuild)`)
 	manifestCmd.Flags().Bool("with-sbom", false, `export SPDX SBOM document`)
+	manifestCmd.Flags().String("sign-sbom", "", `sign the --with-sbom document as a DSSE-enveloped in-toto attestation, written as "<image>.intoto.jsonl" (key reference: a file path or env://VAR)`)
+	manifestCmd.Flags().Bool("attest-provenance", false, `emit a SLSA provenance attestation referencing the manifest, image and blueprint digests`)
 	rootCmd.AddCommand(manifestCmd)
 
 	uploadCmd := &cobra.Command{
@@ -369,6 +471,17 @@ operating systems like Fedora, CentOS and RHEL with easy customizations support.
 	uploadCmd.Flags().String("aws-ami-name", "", "name for the AMI in AWS (only for type=ami)")
 	uploadCmd.Flags().String("aws-bucket", "", "target S3 bucket name for intermediate storage when creating AMI (only for type=ami)")
 	uploadCmd.Flags().String("aws-region", "", "target region for AWS uploads (only for type=ami)")
+	uploadCmd.Flags().String("azure-storage-account", "", "target storage account for intermediate VHD storage (only for type=vhd)")
+	uploadCmd.Flags().String("azure-container", "", "target storage container for intermediate VHD storage (only for type=vhd)")
+	uploadCmd.Flags().String("azure-resource-group", "", "resource group to create the Managed Image in (only for type=vhd)")
+	uploadCmd.Flags().String("azure-location", "", "location for the Managed Image (only for type=vhd)")
+	uploadCmd.Flags().String("azure-image-name", "", "name for the Managed Image in Azure (only for type=vhd)")
+	uploadCmd.Flags().String("azure-gallery", "", "Shared Image Gallery name; publishing to a gallery is not supported and setting this makes the upload fail (only for type=vhd)")
+	uploadCmd.Flags().String("azure-gallery-image-definition", "", "Shared Image Gallery image definition; not used by the upload (only for type=vhd)")
+	uploadCmd.Flags().String("gcp-bucket", "", "target GCS bucket for intermediate tarball storage (only for type=gce)")
+	uploadCmd.Flags().String("gcp-project", "", "target GCP project to create the Compute Image in (only for type=gce)")
+	uploadCmd.Flags().String("gcp-image-name", "", "name for the Compute Image in GCP (only for type=gce)")
+	uploadCmd.Flags().String("arch", "", "architecture of the image being uploaded, e.g. x86_64 or aarch64 (only used by the aws uploader; defaults to x86_64)")
 	rootCmd.AddCommand(uploadCmd)
 
 	buildCmd := &cobra.Command{
@@ -385,12 +498,31 @@ operating systems like Fedora, CentOS and RHEL with easy customizations support.
 	// XXX: add "--verbose" here, similar to how bib is doing this
 	// (see https://github.com/osbuild/bootc-image-builder/pull/790/commits/5cec7ffd8a526e2ca1e8ada0ea18f927695dfe43)
 	buildCmd.Flags().String("progress", "auto", "type of progress bar to use (e.g. verbose,term)")
+	buildCmd.Flags().Bool("foreign-arch", false, `allow building for a foreign --arch via a registered binfmt_misc/QEMU interpreter`)
+	buildCmd.Flags().Bool("dry-run", false, `don't build, just print the manifest digest, cache-hit status and the stages that would run`)
 	rootCmd.AddCommand(buildCmd)
+
 	buildCmd.Flags().AddFlagSet(uploadCmd.Flags())
 	// add after the rest of the uploadCmd flag set is added to avoid
 	// that build gets a "--to" parameter
 	uploadCmd.Flags().String("to", "", "upload to the given cloud")
 
+	// planCmd's flags are copied from buildCmd's *after* the upload flag
+	// set above, so "plan" really does accept the same flags as "build"
+	// (it just forces --dry-run on), matching its Short description.
+	planCmd := &cobra.Command{
+		Use:          "plan <image-type>",
+		Short:        "Alias for \"build --dry-run\": print the manifest digest, cache-hit status and the stages a build would run",
+		RunE:         cmdBuild,
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Flags().Set("dry-run", "true")
+		},
+	}
+	planCmd.Flags().AddFlagSet(buildCmd.Flags())
+	rootCmd.AddCommand(planCmd)
+
 	// XXX: add --format=json too?
 	describeImgCmd := &cobra.Command{
 		Use:          "describe-image <image-type>",
@@ -405,6 +537,36 @@ operating systems like Fedora, CentOS and RHEL with easy customizations support.
 
 	rootCmd.AddCommand(describeImgCmd)
 
+	manifestListCmd := &cobra.Command{
+		Use:          "manifest-list <spec.yaml|spec.json>",
+		Short:        "Build a set of <distro>/<image-type>/<arch> targets and write a combined manifest list descriptor",
+		RunE:         cmdManifestList,
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(1),
+	}
+	manifestListCmd.Flags().Int("jobs", 1, `number of targets to process concurrently (manifests are generated in parallel; builds and uploads run one target at a time)`)
+	manifestListCmd.Flags().String("cache", "/var/cache/image-builder/store", `osbuild directory to cache intermediate build artifacts, shared across all targets`)
+	manifestListCmd.Flags().String("progress", "auto", "type of progress bar to use (e.g. verbose,term)")
+	// reuse upload's cloud flag groups (including "--to") so each per-arch
+	// artifact can be uploaded right after it's built
+	manifestListCmd.Flags().AddFlagSet(uploadCmd.Flags())
+	rootCmd.AddCommand(manifestListCmd)
+
+	batchCmd := &cobra.Command{
+		Use:          "batch <spec.yaml|spec.json>",
+		Short:        "Build a set of jobs described in a spec file, fanning out across a worker pool",
+		RunE:         cmdBatch,
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(1),
+	}
+	batchCmd.Flags().Int("jobs", 0, `number of jobs to process concurrently (default: GOMAXPROCS; manifests are generated in parallel, builds and uploads run one job at a time)`)
+	batchCmd.Flags().String("cache", "/var/cache/image-builder/store", `osbuild directory to cache intermediate build artifacts, shared across all jobs`)
+	batchCmd.Flags().String("progress", "auto", "type of progress bar to use (e.g. verbose,term)")
+	// reuse upload's cloud flag groups so a job's "upload_to" can actually
+	// upload the artifact it just built
+	batchCmd.Flags().AddFlagSet(uploadCmd.Flags())
+	rootCmd.AddCommand(batchCmd)
+
 	return rootCmd.Execute()
 }
 
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// manifestListTarget is a single "<distro>/<image-type>/<arch>" entry to
+// build as part of a manifest list.
+type manifestListTarget struct {
+	Distro    string `json:"distro" yaml:"distro"`
+	ImageType string `json:"image_type" yaml:"image_type"`
+	Arch      string `json:"arch" yaml:"arch"`
+	Blueprint string `json:"blueprint,omitempty" yaml:"blueprint,omitempty"`
+}
+
+// manifestListSpec is the top-level spec file format accepted by
+// "image-builder manifest-list".
+type manifestListSpec struct {
+	Targets []manifestListTarget `json:"targets" yaml:"targets"`
+}
+
+// manifestListEntry describes one built artifact as recorded in the
+// manifest list descriptor.
+type manifestListEntry struct {
+	Distro       string `json:"distro"`
+	ImageType    string `json:"image_type"`
+	Arch         string `json:"arch"`
+	ArtifactPath string `json:"artifact_path"`
+	Digest       string `json:"digest"`
+	Size         int64  `json:"size"`
+	Error        string `json:"error,omitempty"`
+}
+
+// manifestListDescriptor is the combined "manifest list" written after all
+// targets have been processed.
+type manifestListDescriptor struct {
+	Entries []manifestListEntry `json:"entries"`
+}
+
+// uploadManifestEntry records the outcome of uploading a single
+// per-arch artifact from a manifest list, as requested via "--to".
+type uploadManifestEntry struct {
+	Distro       string `json:"distro"`
+	ImageType    string `json:"image_type"`
+	Arch         string `json:"arch"`
+	CloudImageID string `json:"cloud_image_id,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// uploadManifest is the combined upload manifest written to
+// "upload-manifest.json" when "--to" is given to "manifest-list" and every
+// target built successfully; if any target failed, nothing is uploaded.
+type uploadManifest struct {
+	Provider string                `json:"provider"`
+	Entries  []uploadManifestEntry `json:"entries"`
+}
+
+func loadManifestListSpec(path string) (*manifestListSpec, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read manifest-list spec: %w", err)
+	}
+
+	var spec manifestListSpec
+	switch filepath.Ext(path) {
+	case ".json":
+		if err := json.Unmarshal(buf, &spec); err != nil {
+			return nil, fmt.Errorf("cannot parse manifest-list spec: %w", err)
+		}
+	default:
+		if err := yaml.Unmarshal(buf, &spec); err != nil {
+			return nil, fmt.Errorf("cannot parse manifest-list spec: %w", err)
+		}
+	}
+	if len(spec.Targets) == 0 {
+		return nil, fmt.Errorf("manifest-list spec %q has no targets", path)
+	}
+	return &spec, nil
+}
+
+// buildManifestListTarget builds a single target and returns the resulting
+// manifest list entry. Errors are captured in the entry rather than
+// returned so that one failing target does not abort the others.
+func buildManifestListTarget(pbar *muxProgress, t manifestListTarget, repoOpts *repoOptions, cacheDir, outputDir string) manifestListEntry {
+	entry := manifestListEntry{
+		Distro:    t.Distro,
+		ImageType: t.ImageType,
+		Arch:      t.Arch,
+	}
+
+	img, err := getOneImage(t.Distro, t.ImageType, t.Arch, repoOpts)
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+
+	var mf bytes.Buffer
+	opts := &manifestOptions{
+		BlueprintPath: t.Blueprint,
+	}
+	if err := generateManifest(repoOpts.DataDir, repoOpts.ExtraRepos, img, &mf, opts); err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+
+	targetDir := filepath.Join(outputDir, fmt.Sprintf("%s-%s-%s", t.Distro, t.ImageType, t.Arch))
+	buildOpts := &buildOptions{
+		OutputDir: targetDir,
+		StoreDir:  cacheDir,
+	}
+	label := fmt.Sprintf("Building %s/%s/%s", t.Distro, t.ImageType, t.Arch)
+	err = pbar.withJob(label, func(pbar progressBarT) error {
+		return buildImage(pbar, img, mf.Bytes(), buildOpts)
+	})
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+
+	artifactPath := filepath.Join(targetDir, img.ImgType.Name(), img.ImgType.Filename())
+	entry.ArtifactPath = artifactPath
+	if fi, err := os.Stat(artifactPath); err == nil {
+		entry.Size = fi.Size()
+	}
+	if digest, err := sha256OfFile(artifactPath); err == nil {
+		entry.Digest = digest
+	}
+
+	return entry
+}
+
+// uploadManifestListTarget uploads a single successfully built target and
+// returns the resulting upload manifest entry. Like
+// buildManifestListTarget, errors are captured in the entry rather than
+// returned so that one failing upload doesn't abort the others.
+func uploadManifestListTarget(pbar *muxProgress, cmd *cobra.Command, e manifestListEntry) uploadManifestEntry {
+	out := uploadManifestEntry{Distro: e.Distro, ImageType: e.ImageType, Arch: e.Arch}
+
+	uploader, err := uploaderFor(cmd, e.ImageType)
+	if err != nil {
+		out.Error = err.Error()
+		return out
+	}
+
+	label := fmt.Sprintf("Uploading %s/%s/%s", e.Distro, e.ImageType, e.Arch)
+	err = pbar.withJob(label, func(pbar progressBarT) error {
+		if err := uploaderCheckWithProgress(pbar, uploader); err != nil {
+			return err
+		}
+		id, err := uploader.Upload(e.ArtifactPath, e.Arch)
+		if err != nil {
+			return err
+		}
+		out.CloudImageID = id
+		return nil
+	})
+	if err != nil {
+		out.Error = err.Error()
+	}
+	return out
+}
+
+func cmdManifestList(cmd *cobra.Command, args []string) error {
+	specPath := args[0]
+	jobs, err := cmd.Flags().GetInt("jobs")
+	if err != nil {
+		return err
+	}
+	cacheDir, err := cmd.Flags().GetString("cache")
+	if err != nil {
+		return err
+	}
+	outputDir, err := cmd.Flags().GetString("output-dir")
+	if err != nil {
+		return err
+	}
+	dataDir, err := cmd.Flags().GetString("datadir")
+	if err != nil {
+		return err
+	}
+	extraRepos, err := cmd.Flags().GetStringArray("extra-repo")
+	if err != nil {
+		return err
+	}
+	forceRepos, err := cmd.Flags().GetStringArray("force-repo")
+	if err != nil {
+		return err
+	}
+	to, err := cmd.Flags().GetString("to")
+	if err != nil {
+		return err
+	}
+	if outputDir == "" {
+		outputDir = "."
+	}
+	if jobs <= 0 {
+		jobs = 1
+	}
+
+	spec, err := loadManifestListSpec(specPath)
+	if err != nil {
+		return err
+	}
+
+	pbarInner, err := progressFromCmd(cmd)
+	if err != nil {
+		return err
+	}
+	pbarInner.Start()
+	defer pbarInner.Stop()
+	pbar := newMuxProgress(pbarInner)
+
+	repoOpts := &repoOptions{
+		DataDir:    dataDir,
+		ExtraRepos: extraRepos,
+		ForceRepos: forceRepos,
+	}
+
+	entries := make([]manifestListEntry, len(spec.Targets))
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i, t := range spec.Targets {
+		wg.Add(1)
+		go func(i int, t manifestListTarget) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			entries[i] = buildManifestListTarget(pbar, t, repoOpts, cacheDir, outputDir)
+		}(i, t)
+	}
+	wg.Wait()
+
+	descriptor := manifestListDescriptor{Entries: entries}
+	buf, err := json.MarshalIndent(descriptor, "", "  ")
+	if err != nil {
+		return err
+	}
+	descriptorPath := filepath.Join(outputDir, "manifest-list.json")
+	if err := os.WriteFile(descriptorPath, buf, 0o644); err != nil {
+		return fmt.Errorf("cannot write manifest list descriptor: %w", err)
+	}
+	fmt.Fprintf(osStdout, "wrote manifest list to %s\n", descriptorPath)
+
+	var errs []error
+	for _, e := range entries {
+		if e.Error != "" {
+			errs = append(errs, fmt.Errorf("%s/%s/%s: %s", e.Distro, e.ImageType, e.Arch, e.Error))
+		}
+	}
+
+	if to != "" && len(errs) == 0 {
+		uploads := make([]uploadManifestEntry, len(entries))
+		var uwg sync.WaitGroup
+		for i, e := range entries {
+			uwg.Add(1)
+			go func(i int, e manifestListEntry) {
+				defer uwg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				uploads[i] = uploadManifestListTarget(pbar, cmd, e)
+			}(i, e)
+		}
+		uwg.Wait()
+
+		um := uploadManifest{Provider: to, Entries: uploads}
+		ubuf, err := json.MarshalIndent(um, "", "  ")
+		if err != nil {
+			return err
+		}
+		uploadManifestPath := filepath.Join(outputDir, "upload-manifest.json")
+		if err := os.WriteFile(uploadManifestPath, ubuf, 0o644); err != nil {
+			return fmt.Errorf("cannot write upload manifest: %w", err)
+		}
+		fmt.Fprintf(osStdout, "wrote upload manifest to %s\n", uploadManifestPath)
+
+		for _, u := range uploads {
+			if u.Error != "" {
+				errs = append(errs, fmt.Errorf("upload %s/%s/%s: %s", u.Distro, u.ImageType, u.Arch, u.Error))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d targets failed: %w", len(errs), len(entries), errors.Join(errs...))
+	}
+	return nil
+}
+
+// sha256OfFile returns the hex-encoded SHA256 digest of the file at path.
+func sha256OfFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
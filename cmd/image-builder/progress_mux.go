@@ -0,0 +1,41 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/osbuild/bootc-image-builder/bib/pkg/progress"
+)
+
+// progressBarT is a short alias for the progress bar interface, used by
+// the worker-pool commands (manifest-list, batch) that pass it through
+// several layers of closures.
+type progressBarT = progress.ProgressBar
+
+// muxProgress serializes access to a single progress.ProgressBar so it
+// can be shared by a worker pool. progress.ProgressBar is driven from a
+// single goroutine everywhere else in this codebase, so without this,
+// concurrent SetMessagef/SetPulseMsgf/buildImage calls from multiple
+// workers would race on it and garble its output.
+//
+// Jobs still resolve their distro/manifest/repos concurrently; only the
+// section that actually touches pbar (including the buildImage call
+// itself) is serialized, which keeps one line of progress per job
+// legible without serializing the rest of the work.
+type muxProgress struct {
+	progress.ProgressBar
+	mu sync.Mutex
+}
+
+func newMuxProgress(pbar progress.ProgressBar) *muxProgress {
+	return &muxProgress{ProgressBar: pbar}
+}
+
+// withJob runs fn while holding the mux lock, after announcing the job
+// via SetMessagef, so each job's progress is printed as a single,
+// non-interleaved line.
+func (m *muxProgress) withJob(label string, fn func(pbar progress.ProgressBar) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.SetMessagef("%s", label)
+	return fn(m.ProgressBar)
+}
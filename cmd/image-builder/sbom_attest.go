@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/osbuild/images/pkg/imagefilter"
+)
+
+// inTotoStatement is a minimal in-toto v1.0 Statement
+// (https://in-toto.io/Statement/v1).
+type inTotoStatement struct {
+	Type          string          `json:"_type"`
+	PredicateType string          `json:"predicateType"`
+	Subject       []inTotoSubject `json:"subject"`
+	Predicate     any             `json:"predicate"`
+}
+
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// dsseEnvelope is a minimal DSSE (https://github.com/secure-systems-lab/dsse)
+// envelope as used by in-toto attestations.
+type dsseEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     string          `json:"payload"`
+	Signatures  []dsseSignature `json:"signatures"`
+}
+
+type dsseSignature struct {
+	KeyID string `json:"keyid,omitempty"`
+	Sig   string `json:"sig"`
+}
+
+// slsaProvenancePredicate is a minimal SLSA v1.0 provenance predicate
+// (https://slsa.dev/spec/v1.0/provenance).
+type slsaProvenancePredicate struct {
+	BuildType          string         `json:"buildType"`
+	ExternalParameters map[string]any `json:"externalParameters"`
+}
+
+// sbomKeySigner signs DSSE payloads. Plain file paths and env:// key refs
+// are backed by a raw ed25519 private key; any other "scheme://" ref
+// (including file:// and cosign-style KMS URIs) is rejected.
+type sbomKeySigner struct {
+	keyID string
+	priv  ed25519.PrivateKey
+}
+
+func newSBOMKeySigner(keyRef string) (*sbomKeySigner, error) {
+	var raw []byte
+	switch {
+	case strings.HasPrefix(keyRef, "env://"):
+		envVar := strings.TrimPrefix(keyRef, "env://")
+		val, ok := os.LookupEnv(envVar)
+		if !ok {
+			return nil, fmt.Errorf("sign-sbom: environment variable %q is not set", envVar)
+		}
+		raw = []byte(val)
+	case strings.Contains(keyRef, "://"):
+		return nil, fmt.Errorf("sign-sbom: key reference scheme %q is not supported yet (only file paths and env:// are)", keyRef)
+	default:
+		buf, err := os.ReadFile(keyRef)
+		if err != nil {
+			return nil, fmt.Errorf("sign-sbom: cannot read key file: %w", err)
+		}
+		raw = buf
+	}
+
+	priv, err := decodeEd25519PrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("sign-sbom: %w", err)
+	}
+	return &sbomKeySigner{keyID: keyRef, priv: priv}, nil
+}
+
+func decodeEd25519PrivateKey(raw []byte) (ed25519.PrivateKey, error) {
+	raw = []byte(strings.TrimSpace(string(raw)))
+	dec, err := base64.StdEncoding.DecodeString(string(raw))
+	if err != nil {
+		return nil, fmt.Errorf("expected a base64-encoded raw ed25519 private key: %w", err)
+	}
+	if len(dec) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("expected a %d byte ed25519 private key, got %d bytes", ed25519.PrivateKeySize, len(dec))
+	}
+	return ed25519.PrivateKey(dec), nil
+}
+
+// sign produces a DSSE envelope for payload using the PAE encoding
+// (https://github.com/secure-systems-lab/dsse/blob/master/protocol.md#signature-definition).
+func (s *sbomKeySigner) sign(payloadType string, payload []byte) (*dsseEnvelope, error) {
+	pae := dssePAE(payloadType, payload)
+	sig := ed25519.Sign(s.priv, pae)
+
+	return &dsseEnvelope{
+		PayloadType: payloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures: []dsseSignature{
+			{KeyID: s.keyID, Sig: base64.StdEncoding.EncodeToString(sig)},
+		},
+	}, nil
+}
+
+func dssePAE(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// signSBOMAttestation wraps the SPDX document at sbomPath in an in-toto
+// statement, signs it as a DSSE envelope with keyRef, and writes the
+// result next to the image as "<image>.intoto.jsonl".
+func signSBOMAttestation(sbomPath, imagePath, keyRef string) error {
+	sbomBytes, err := os.ReadFile(sbomPath)
+	if err != nil {
+		return fmt.Errorf("sign-sbom: cannot read SBOM %q: %w", sbomPath, err)
+	}
+	digest, err := sha256OfFile(imagePath)
+	if err != nil {
+		return fmt.Errorf("sign-sbom: cannot digest image %q: %w", imagePath, err)
+	}
+
+	statement := inTotoStatement{
+		Type:          "https://in-toto.io/Statement/v1",
+		PredicateType: "https://spdx.dev/Document",
+		Subject: []inTotoSubject{
+			{Name: filepath.Base(imagePath), Digest: map[string]string{"sha256": digest}},
+		},
+		Predicate: json.RawMessage(sbomBytes),
+	}
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return fmt.Errorf("sign-sbom: %w", err)
+	}
+
+	signer, err := newSBOMKeySigner(keyRef)
+	if err != nil {
+		return err
+	}
+	envelope, err := signer.sign("application/vnd.in-toto+json", payload)
+	if err != nil {
+		return fmt.Errorf("sign-sbom: %w", err)
+	}
+
+	return writeIntotoAttestation(imagePath, envelope)
+}
+
+// writeProvenanceAttestation emits a SLSA v1.0 provenance predicate
+// referencing the osbuild manifest, the image digest, the blueprint
+// path/digest and the resolved repository baseurls used during the
+// build, as an unsigned in-toto statement next to the image.
+func writeProvenanceAttestation(img *imagefilter.Result, imagePath, manifestDigest, blueprintPath string) error {
+	digest, err := sha256OfFile(imagePath)
+	if err != nil {
+		return fmt.Errorf("attest-provenance: cannot digest image %q: %w", imagePath, err)
+	}
+
+	blueprint := map[string]any{"path": blueprintPath}
+	if blueprintPath != "" {
+		blueprintDigest, err := sha256OfFile(blueprintPath)
+		if err != nil {
+			return fmt.Errorf("attest-provenance: cannot digest blueprint %q: %w", blueprintPath, err)
+		}
+		blueprint["digest"] = "sha256:" + blueprintDigest
+	}
+
+	var repoBaseURLs []string
+	for _, repo := range img.Repos {
+		repoBaseURLs = append(repoBaseURLs, repo.BaseURLs...)
+	}
+
+	predicate := slsaProvenancePredicate{
+		BuildType: "https://osbuild.org/image-builder-cli/Build/v1",
+		ExternalParameters: map[string]any{
+			"distro":         img.Distro.Name(),
+			"imageType":      img.ImgType.Name(),
+			"arch":           img.Arch.Name(),
+			"blueprint":      blueprint,
+			"manifestDigest": "sha256:" + manifestDigest,
+			"repositories":   repoBaseURLs,
+		},
+	}
+	statement := inTotoStatement{
+		Type:          "https://in-toto.io/Statement/v1",
+		PredicateType: "https://slsa.dev/provenance/v1",
+		Subject: []inTotoSubject{
+			{Name: filepath.Base(imagePath), Digest: map[string]string{"sha256": digest}},
+		},
+		Predicate: predicate,
+	}
+
+	buf, err := json.Marshal(statement)
+	if err != nil {
+		return fmt.Errorf("attest-provenance: %w", err)
+	}
+	envelope := &dsseEnvelope{
+		PayloadType: "application/vnd.in-toto+json",
+		Payload:     base64.StdEncoding.EncodeToString(buf),
+	}
+	return writeIntotoAttestation(imagePath+".provenance", envelope)
+}
+
+func writeIntotoAttestation(basePath string, envelope *dsseEnvelope) error {
+	buf, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	path := basePath + ".intoto.jsonl"
+	if err := os.WriteFile(path, buf, 0o644); err != nil {
+		return fmt.Errorf("cannot write attestation %q: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+)
+
+func TestDssePAE(t *testing.T) {
+	got := string(dssePAE("application/vnd.in-toto+json", []byte("hello")))
+	want := "DSSEv1 28 application/vnd.in-toto+json 5 hello"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestDecodeEd25519PrivateKey(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(priv)
+
+	got, err := decodeEd25519PrivateKey([]byte(encoded + "\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !got.Equal(priv) {
+		t.Fatal("decoded private key does not match the original")
+	}
+}
+
+func TestDecodeEd25519PrivateKeyInvalid(t *testing.T) {
+	if _, err := decodeEd25519PrivateKey([]byte("not base64 at all!!")); err == nil {
+		t.Fatal("expected an error for non-base64 input")
+	}
+
+	short := base64.StdEncoding.EncodeToString([]byte("too short"))
+	if _, err := decodeEd25519PrivateKey([]byte(short)); err == nil {
+		t.Fatal("expected an error for a key of the wrong size")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/osbuild/bootc-image-builder/bib/pkg/progress"
+)
+
+// Uploader uploads a built image artifact to a cloud provider and
+// registers it as a cloud-native image (AMI, Managed Image, Compute
+// Image, ...).
+type Uploader interface {
+	// Name is a short, human readable identifier for progress/error
+	// messages, e.g. "aws", "azure", "gcp".
+	Name() string
+	// Check verifies that the uploader has everything it needs (API
+	// access, target bucket/container/resource-group, ...). "build" calls
+	// it before the (potentially long) build is started; "batch" and
+	// "manifest-list" call it after the build, right before uploading.
+	Check(pbar progress.ProgressBar) error
+	// Upload uploads the image at imagePath, built for the given
+	// architecture (e.g. "x86_64", "aarch64"; may be "" if unknown), and
+	// returns a provider specific identifier for the resulting cloud
+	// image (AMI id, Managed Image resource id, Compute Image
+	// self-link, ...).
+	Upload(imagePath, arch string) (string, error)
+}
+
+// UploadTypeUnsupportedError is returned by uploaderFor when no uploader
+// is registered for the given image type.
+type UploadTypeUnsupportedError struct {
+	ImgType string
+}
+
+func (e *UploadTypeUnsupportedError) Error() string {
+	return fmt.Sprintf("no uploader available for image type %q", e.ImgType)
+}
+
+// MissingUploadConfigError is returned by uploaderFor when some but not
+// all of a cloud provider's required flags were set. allMissing is true
+// when none of the provider's flags were set at all, in which case the
+// caller should treat upload as simply "not requested".
+type MissingUploadConfigError struct {
+	Provider   string
+	allMissing bool
+}
+
+func (e *MissingUploadConfigError) Error() string {
+	return fmt.Sprintf("missing upload configuration for %s", e.Provider)
+}
+
+// uploaderEntry wires an image type to the cloud provider that can
+// publish it and the constructor that builds an Uploader from the
+// command's flags.
+type uploaderEntry struct {
+	provider string
+	newFunc  func(cmd *cobra.Command) (Uploader, error)
+}
+
+// uploaderRegistry maps an image type name (as reported by
+// imagefilter.Result.ImgType.Name()) to the uploader that can publish it.
+var uploaderRegistry = map[string]uploaderEntry{
+	"ami": {provider: "aws", newFunc: newAWSUploader},
+	"vhd": {provider: "azure", newFunc: newAzureUploader},
+	"gce": {provider: "gcp", newFunc: newGCPUploader},
+}
+
+// uploaderFor returns the Uploader for imgType based on the
+// provider-specific flags set on cmd. The provider is chosen from imgType
+// alone; "--to" is not consulted. It returns a *MissingUploadConfigError
+// when no upload was requested (allMissing == true) or only part of a
+// provider's flags were set (allMissing == false, a user mistake).
+func uploaderFor(cmd *cobra.Command, imgType string) (Uploader, error) {
+	entry, ok := uploaderRegistry[imgType]
+	if !ok {
+		return nil, &UploadTypeUnsupportedError{ImgType: imgType}
+	}
+
+	uploader, err := entry.newFunc(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if uploader == nil {
+		return nil, &MissingUploadConfigError{Provider: entry.provider, allMissing: true}
+	}
+	return uploader, nil
+}
+
+func uploaderCheckWithProgress(pbar progress.ProgressBar, uploader Uploader) error {
+	if err := uploader.Check(pbar); err != nil {
+		return fmt.Errorf("%s: %w", uploader.Name(), err)
+	}
+	return nil
+}
+
+func uploadImageWithProgress(uploader Uploader, imagePath, arch string) error {
+	pbar, err := progress.New("auto")
+	if err != nil {
+		return err
+	}
+	pbar.Start()
+	defer pbar.Stop()
+	pbar.SetPulseMsgf("Uploading image to %s", uploader.Name())
+
+	id, err := uploader.Upload(imagePath, arch)
+	if err != nil {
+		return fmt.Errorf("%s: %w", uploader.Name(), err)
+	}
+	fmt.Fprintf(osStdout, "uploaded %s as %s\n", imagePath, id)
+	return nil
+}
+
+func cmdUpload(cmd *cobra.Command, args []string) error {
+	imagePath := args[0]
+	to, err := cmd.Flags().GetString("to")
+	if err != nil {
+		return err
+	}
+	if to == "" {
+		return fmt.Errorf("--to is required, e.g. --to=aws")
+	}
+	arch, err := cmd.Flags().GetString("arch")
+	if err != nil {
+		return err
+	}
+
+	entry, ok := uploaderRegistryByProvider(to)
+	if !ok {
+		return fmt.Errorf("unknown upload provider %q", to)
+	}
+	uploader, err := entry.newFunc(cmd)
+	if err != nil {
+		return err
+	}
+	if uploader == nil {
+		return &MissingUploadConfigError{Provider: entry.provider, allMissing: true}
+	}
+
+	pbar, err := progress.New("auto")
+	if err != nil {
+		return err
+	}
+	pbar.Start()
+	defer pbar.Stop()
+	if err := uploaderCheckWithProgress(pbar, uploader); err != nil {
+		return err
+	}
+	pbar.Stop()
+
+	return uploadImageWithProgress(uploader, imagePath, arch)
+}
+
+func uploaderRegistryByProvider(provider string) (uploaderEntry, bool) {
+	for _, entry := range uploaderRegistry {
+		if entry.provider == provider {
+			return entry, true
+		}
+	}
+	return uploaderEntry{}, false
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/osbuild/bootc-image-builder/bib/pkg/progress"
+)
+
+// awsUploader uploads a raw disk image to S3 and registers it as an AMI,
+// via EC2's ImportSnapshot/RegisterImage APIs. It signs requests itself
+// (see awssig.go) rather than depending on the AWS SDK, and picks up
+// credentials from the standard AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY/
+// AWS_SESSION_TOKEN environment variables.
+type awsUploader struct {
+	AMIName string
+	Bucket  string
+	Region  string
+}
+
+func (u *awsUploader) Name() string {
+	return "aws"
+}
+
+func (u *awsUploader) Check(pbar progress.ProgressBar) error {
+	pbar.SetPulseMsgf("Checking AWS access")
+	_, err := awsCredentialsFromEnv()
+	return err
+}
+
+// Upload uploads imagePath to u.Bucket, imports it as an EBS snapshot via
+// EC2's ImportSnapshot, and registers the resulting snapshot as an AMI
+// named u.AMIName. It returns the new AMI id (e.g. "ami-0123456789abcdef0").
+func (u *awsUploader) Upload(imagePath, arch string) (string, error) {
+	creds, err := awsCredentialsFromEnv()
+	if err != nil {
+		return "", err
+	}
+	ec2Arch, err := ec2ArchitectureFor(arch)
+	if err != nil {
+		return "", err
+	}
+
+	key := fmt.Sprintf("image-builder/%d-%s", time.Now().UnixNano(), filepath.Base(imagePath))
+	if err := s3PutObject(creds, u.Region, u.Bucket, key, imagePath); err != nil {
+		return "", fmt.Errorf("upload to s3: %w", err)
+	}
+
+	taskID, err := ec2ImportSnapshot(creds, u.Region, u.Bucket, key)
+	if err != nil {
+		return "", fmt.Errorf("import snapshot: %w", err)
+	}
+
+	snapshotID, err := ec2WaitImportSnapshot(creds, u.Region, taskID)
+	if err != nil {
+		return "", fmt.Errorf("wait for snapshot import: %w", err)
+	}
+
+	amiID, err := ec2RegisterImage(creds, u.Region, u.AMIName, snapshotID, ec2Arch)
+	if err != nil {
+		return "", fmt.Errorf("register image: %w", err)
+	}
+	return amiID, nil
+}
+
+// ec2ArchitectureFor maps an image-builder arch string (e.g. "x86_64",
+// "aarch64") to the "Architecture" value EC2's RegisterImage expects. An
+// empty arch (e.g. from the standalone "upload" command, which has no
+// associated build) defaults to "x86_64" to match this uploader's
+// original, single-architecture behavior.
+func ec2ArchitectureFor(arch string) (string, error) {
+	switch arch {
+	case "", "x86_64":
+		return "x86_64", nil
+	case "aarch64":
+		return "arm64", nil
+	default:
+		return "", fmt.Errorf("aws: unsupported architecture %q", arch)
+	}
+}
+
+func newAWSUploader(cmd *cobra.Command) (Uploader, error) {
+	amiName, err := cmd.Flags().GetString("aws-ami-name")
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := cmd.Flags().GetString("aws-bucket")
+	if err != nil {
+		return nil, err
+	}
+	region, err := cmd.Flags().GetString("aws-region")
+	if err != nil {
+		return nil, err
+	}
+
+	set := []bool{amiName != "", bucket != "", region != ""}
+	if !anyTrue(set) {
+		return nil, nil
+	}
+	if !allTrue(set) {
+		return nil, &MissingUploadConfigError{Provider: "aws"}
+	}
+
+	return &awsUploader{AMIName: amiName, Bucket: bucket, Region: region}, nil
+}
+
+func anyTrue(bs []bool) bool {
+	for _, b := range bs {
+		if b {
+			return true
+		}
+	}
+	return false
+}
+
+func allTrue(bs []bool) bool {
+	for _, b := range bs {
+		if !b {
+			return false
+		}
+	}
+	return true
+}
+
+// s3PutObject uploads the file at path to bucket/key using a single PUT
+// (no multipart), signed with SigV4. The payload is streamed straight
+// from disk with "UNSIGNED-PAYLOAD" so large images don't need to be
+// hashed or buffered up front.
+func s3PutObject(creds *awsCredentials, region, bucket, key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, region, key)
+	req, err := http.NewRequest(http.MethodPut, endpoint, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fi.Size()
+
+	if err := sigV4Sign(req, creds, "s3", region, "UNSIGNED-PAYLOAD"); err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("s3 PutObject: %s: %s", resp.Status, string(body))
+	}
+	return nil
+}
+
+// ec2Request POSTs a signed EC2 "query API" request (Action=...,
+// Version=..., plus provider-specific parameters) and unmarshals the XML
+// response body into out.
+func ec2Request(creds *awsCredentials, region string, params url.Values, out interface{}) error {
+	endpoint := fmt.Sprintf("https://ec2.%s.amazonaws.com/", region)
+	body := params.Encode()
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if err := sigV4Sign(req, creds, "ec2", region, hashHex(body)); err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s: %s", params.Get("Action"), resp.Status, string(respBody))
+	}
+	return xml.Unmarshal(respBody, out)
+}
+
+func ec2ImportSnapshot(creds *awsCredentials, region, bucket, key string) (string, error) {
+	params := url.Values{
+		"Action":                            {"ImportSnapshot"},
+		"Version":                           {"2016-11-15"},
+		"DiskContainer.Format":              {"raw"},
+		"DiskContainer.UserBucket.S3Bucket": {bucket},
+		"DiskContainer.UserBucket.S3Key":    {key},
+	}
+	var out struct {
+		XMLName      xml.Name `xml:"ImportSnapshotResponse"`
+		ImportTaskID string   `xml:"importTaskId"`
+	}
+	if err := ec2Request(creds, region, params, &out); err != nil {
+		return "", err
+	}
+	if out.ImportTaskID == "" {
+		return "", fmt.Errorf("ImportSnapshot response had no importTaskId")
+	}
+	return out.ImportTaskID, nil
+}
+
+// ec2WaitImportSnapshot polls DescribeImportSnapshotTasks until the given
+// task completes (or errors out), returning the resulting snapshot id.
+func ec2WaitImportSnapshot(creds *awsCredentials, region, taskID string) (string, error) {
+	params := url.Values{
+		"Action":         {"DescribeImportSnapshotTasks"},
+		"Version":        {"2016-11-15"},
+		"ImportTaskId.1": {taskID},
+	}
+	for {
+		var out struct {
+			XMLName xml.Name `xml:"DescribeImportSnapshotTasksResponse"`
+			Tasks   struct {
+				Items []struct {
+					Detail struct {
+						Status     string `xml:"status"`
+						StatusMsg  string `xml:"statusMessage"`
+						SnapshotID string `xml:"snapshotId"`
+					} `xml:"snapshotTaskDetail"`
+				} `xml:"item"`
+			} `xml:"importSnapshotTaskSet"`
+		}
+		if err := ec2Request(creds, region, params, &out); err != nil {
+			return "", err
+		}
+		if len(out.Tasks.Items) == 0 {
+			return "", fmt.Errorf("import task %s not found", taskID)
+		}
+		detail := out.Tasks.Items[0].Detail
+		switch detail.Status {
+		case "completed":
+			if detail.SnapshotID == "" {
+				return "", fmt.Errorf("import task %s completed without a snapshot id", taskID)
+			}
+			return detail.SnapshotID, nil
+		case "deleted", "deleting":
+			return "", fmt.Errorf("import task %s failed: %s", taskID, detail.StatusMsg)
+		default:
+			time.Sleep(15 * time.Second)
+		}
+	}
+}
+
+func ec2RegisterImage(creds *awsCredentials, region, name, snapshotID, arch string) (string, error) {
+	params := url.Values{
+		"Action":                              {"RegisterImage"},
+		"Version":                             {"2016-11-15"},
+		"Name":                                {name},
+		"Architecture":                        {arch},
+		"VirtualizationType":                  {"hvm"},
+		"RootDeviceName":                      {"/dev/sda1"},
+		"BlockDeviceMapping.1.DeviceName":     {"/dev/sda1"},
+		"BlockDeviceMapping.1.Ebs.SnapshotId": {snapshotID},
+		"BlockDeviceMapping.1.Ebs.DeleteOnTermination": {"true"},
+	}
+	var out struct {
+		XMLName xml.Name `xml:"RegisterImageResponse"`
+		ImageID string   `xml:"imageId"`
+	}
+	if err := ec2Request(creds, region, params, &out); err != nil {
+		return "", err
+	}
+	if out.ImageID == "" {
+		return "", fmt.Errorf("RegisterImage response had no imageId")
+	}
+	return out.ImageID, nil
+}
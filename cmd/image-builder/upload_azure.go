@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/osbuild/bootc-image-builder/bib/pkg/progress"
+)
+
+// azureUploader uploads a VHD to a storage account/container and
+// registers it as a Managed Image. Shared Image Gallery publishing is not
+// supported: Check and Upload return an error when u.Gallery is set, and
+// u.ImageDef is not used.
+//
+// It talks to Azure Blob Storage and ARM directly over HTTPS (Shared Key
+// auth for the blob PUT, an AAD client-credentials token for ARM) rather
+// than depending on the Azure SDK, and picks up the service principal
+// from the standard AZURE_TENANT_ID/AZURE_CLIENT_ID/AZURE_CLIENT_SECRET
+// environment variables, plus AZURE_STORAGE_ACCOUNT_KEY for the blob
+// upload and AZURE_SUBSCRIPTION_ID for the ARM calls.
+type azureUploader struct {
+	StorageAccount string
+	Container      string
+	ResourceGroup  string
+	Location       string
+	ImageName      string
+	Gallery        string
+	ImageDef       string
+}
+
+func (u *azureUploader) Name() string {
+	return "azure"
+}
+
+func (u *azureUploader) Check(pbar progress.ProgressBar) error {
+	pbar.SetPulseMsgf("Checking Azure access")
+	if u.Gallery != "" {
+		return fmt.Errorf("azure: publishing to a Shared Image Gallery (--azure-gallery) is not supported yet, use --azure-image-name for a Managed Image instead")
+	}
+	if _, err := azureCredentialsFromEnv(); err != nil {
+		return err
+	}
+	if os.Getenv("AZURE_STORAGE_ACCOUNT_KEY") == "" {
+		return fmt.Errorf("AZURE_STORAGE_ACCOUNT_KEY must be set in the environment")
+	}
+	if os.Getenv("AZURE_SUBSCRIPTION_ID") == "" {
+		return fmt.Errorf("AZURE_SUBSCRIPTION_ID must be set in the environment")
+	}
+	return nil
+}
+
+// Upload uploads the VHD at imagePath to u.StorageAccount/u.Container as
+// a page blob, then creates a Managed Image named u.ImageName in
+// u.ResourceGroup/u.Location from it. It returns the new image's ARM
+// resource id.
+func (u *azureUploader) Upload(imagePath, arch string) (string, error) {
+	if u.Gallery != "" {
+		return "", fmt.Errorf("azure: publishing to a Shared Image Gallery (--azure-gallery) is not supported yet, use --azure-image-name for a Managed Image instead")
+	}
+
+	creds, err := azureCredentialsFromEnv()
+	if err != nil {
+		return "", err
+	}
+	accountKey := os.Getenv("AZURE_STORAGE_ACCOUNT_KEY")
+	subscriptionID := os.Getenv("AZURE_SUBSCRIPTION_ID")
+
+	blobName := fmt.Sprintf("image-builder-%d.vhd", time.Now().UnixNano())
+	blobURL, err := azurePutPageBlob(u.StorageAccount, accountKey, u.Container, blobName, imagePath)
+	if err != nil {
+		return "", fmt.Errorf("upload to blob storage: %w", err)
+	}
+
+	token, err := azureADToken(creds)
+	if err != nil {
+		return "", fmt.Errorf("authenticate to ARM: %w", err)
+	}
+
+	resourceID, err := armCreateManagedImage(token, subscriptionID, u.ResourceGroup, u.Location, u.ImageName, blobURL)
+	if err != nil {
+		return "", fmt.Errorf("create managed image: %w", err)
+	}
+	return resourceID, nil
+}
+
+func newAzureUploader(cmd *cobra.Command) (Uploader, error) {
+	storageAccount, err := cmd.Flags().GetString("azure-storage-account")
+	if err != nil {
+		return nil, err
+	}
+	container, err := cmd.Flags().GetString("azure-container")
+	if err != nil {
+		return nil, err
+	}
+	resourceGroup, err := cmd.Flags().GetString("azure-resource-group")
+	if err != nil {
+		return nil, err
+	}
+	location, err := cmd.Flags().GetString("azure-location")
+	if err != nil {
+		return nil, err
+	}
+	imageName, err := cmd.Flags().GetString("azure-image-name")
+	if err != nil {
+		return nil, err
+	}
+	gallery, err := cmd.Flags().GetString("azure-gallery")
+	if err != nil {
+		return nil, err
+	}
+	imageDef, err := cmd.Flags().GetString("azure-gallery-image-definition")
+	if err != nil {
+		return nil, err
+	}
+
+	required := []bool{storageAccount != "", container != "", resourceGroup != "", location != "", imageName != ""}
+	if !anyTrue(required) {
+		return nil, nil
+	}
+	if !allTrue(required) {
+		return nil, &MissingUploadConfigError{Provider: "azure"}
+	}
+
+	return &azureUploader{
+		StorageAccount: storageAccount,
+		Container:      container,
+		ResourceGroup:  resourceGroup,
+		Location:       location,
+		ImageName:      imageName,
+		Gallery:        gallery,
+		ImageDef:       imageDef,
+	}, nil
+}
+
+// azureCredentials is the service principal used to obtain an AAD token
+// for ARM calls.
+type azureCredentials struct {
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+}
+
+func azureCredentialsFromEnv() (*azureCredentials, error) {
+	tenantID := os.Getenv("AZURE_TENANT_ID")
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+	clientSecret := os.Getenv("AZURE_CLIENT_SECRET")
+	if tenantID == "" || clientID == "" || clientSecret == "" {
+		return nil, fmt.Errorf("AZURE_TENANT_ID/AZURE_CLIENT_ID/AZURE_CLIENT_SECRET must be set in the environment")
+	}
+	return &azureCredentials{TenantID: tenantID, ClientID: clientID, ClientSecret: clientSecret}, nil
+}
+
+// azureADToken exchanges the service principal's client credentials for
+// an AAD access token scoped to ARM.
+func azureADToken(creds *azureCredentials) (string, error) {
+	endpoint := fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", creds.TenantID)
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {creds.ClientID},
+		"client_secret": {creds.ClientSecret},
+		"scope":         {"https://management.azure.com/.default"},
+	}
+	resp, err := http.PostForm(endpoint, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", resp.Status, string(body))
+	}
+
+	var out struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return "", err
+	}
+	if out.AccessToken == "" {
+		return "", fmt.Errorf("token response had no access_token")
+	}
+	return out.AccessToken, nil
+}
+
+// azurePutPageBlob uploads the file at path to account/container/blobName
+// as a page blob (the format Azure Blob Storage requires for VHDs),
+// authenticated with a Shared Key, and returns the resulting blob URL.
+func azurePutPageBlob(account, accountKey, container, blobName, path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	// page blobs must be an exact multiple of 512 bytes
+	size := (fi.Size() + 511) / 512 * 512
+
+	blobURL := fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", account, container, blobName)
+	req, err := http.NewRequest(http.MethodPut, blobURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("x-ms-blob-type", "PageBlob")
+	req.Header.Set("x-ms-blob-content-length", fmt.Sprintf("%d", size))
+	req.Header.Set("Content-Length", "0")
+	if err := azureSharedKeySign(req, account, accountKey, 0); err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("create page blob: %s", resp.Status)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	const pageSize = 4 << 20 // 4MiB, well within the 4000MiB-per-range limit
+	buf := make([]byte, pageSize)
+	var offset int64
+	for {
+		n, rerr := io.ReadFull(f, buf)
+		if n == 0 {
+			break
+		}
+		// pad the final (possibly short/odd-sized) chunk up to a 512-byte boundary
+		chunk := buf[:n]
+		if n%512 != 0 {
+			padded := make([]byte, (int64(n)+511)/512*512)
+			copy(padded, chunk)
+			chunk = padded
+		}
+
+		putURL := fmt.Sprintf("%s?comp=page", blobURL)
+		preq, err := http.NewRequest(http.MethodPut, putURL, bytes.NewReader(chunk))
+		if err != nil {
+			return "", err
+		}
+		preq.ContentLength = int64(len(chunk))
+		preq.Header.Set("x-ms-page-write", "update")
+		preq.Header.Set("x-ms-range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(chunk))-1))
+		if err := azureSharedKeySign(preq, account, accountKey, int64(len(chunk))); err != nil {
+			return "", err
+		}
+		presp, err := http.DefaultClient.Do(preq)
+		if err != nil {
+			return "", err
+		}
+		presp.Body.Close()
+		if presp.StatusCode != http.StatusCreated {
+			return "", fmt.Errorf("write page at offset %d: %s", offset, presp.Status)
+		}
+
+		offset += int64(len(chunk))
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return "", rerr
+		}
+	}
+
+	return blobURL, nil
+}
+
+// azureSharedKeySign signs req in place using Azure Storage's "Shared
+// Key" scheme (see
+// https://learn.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key),
+// so blob operations can be made without the Azure SDK.
+func azureSharedKeySign(req *http.Request, account, accountKey string, contentLength int64) error {
+	now := time.Now().UTC().Format(http.TimeFormat)
+	req.Header.Set("x-ms-date", now)
+	req.Header.Set("x-ms-version", "2021-08-06")
+
+	contentLengthStr := ""
+	if contentLength > 0 {
+		contentLengthStr = fmt.Sprintf("%d", contentLength)
+	}
+
+	canonicalHeaders := azureCanonicalizeHeaders(req.Header)
+	canonicalResource := azureCanonicalizeResource(account, req.URL)
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		"", // Content-Encoding
+		"", // Content-Language
+		contentLengthStr,
+		"", // Content-MD5
+		"", // Content-Type
+		"", // Date
+		"", // If-Modified-Since
+		"", // If-Match
+		"", // If-None-Match
+		"", // If-Unmodified-Since
+		"", // Range
+		canonicalHeaders,
+		canonicalResource,
+	}, "\n")
+
+	key, err := base64.StdEncoding.DecodeString(accountKey)
+	if err != nil {
+		return fmt.Errorf("decode storage account key: %w", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", account, signature))
+	return nil
+}
+
+func azureCanonicalizeHeaders(h http.Header) string {
+	var names []string
+	for name := range h {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-ms-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "%s:%s", name, h.Get(name))
+	}
+	return b.String()
+}
+
+func azureCanonicalizeResource(account string, u *url.URL) string {
+	return fmt.Sprintf("/%s%s", account, u.Path)
+}
+
+// armCreateManagedImage creates a Microsoft.Compute/images resource from
+// an uploaded VHD blob and returns its ARM resource id.
+func armCreateManagedImage(token, subscriptionID, resourceGroup, location, imageName, blobURL string) (string, error) {
+	endpoint := fmt.Sprintf(
+		"https://management.azure.com/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/images/%s?api-version=2023-07-01",
+		subscriptionID, resourceGroup, imageName,
+	)
+
+	body := map[string]interface{}{
+		"location": location,
+		"properties": map[string]interface{}{
+			"storageProfile": map[string]interface{}{
+				"osDisk": map[string]interface{}{
+					"osType":  "Linux",
+					"osState": "Generalized",
+					"blobUri": blobURL,
+				},
+			},
+		},
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("%s: %s", resp.Status, string(respBody))
+	}
+
+	var out struct {
+		ID         string `json:"id"`
+		Properties struct {
+			ProvisioningState string `json:"provisioningState"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(respBody, &out); err != nil {
+		return "", err
+	}
+	if out.ID == "" {
+		return "", fmt.Errorf("create image response had no id")
+	}
+
+	if err := armWaitImageProvisioned(token, endpoint, out.Properties.ProvisioningState); err != nil {
+		return "", err
+	}
+	return out.ID, nil
+}
+
+// armWaitImageProvisioned polls the Microsoft.Compute/images resource at
+// endpoint until its provisioningState reaches a terminal state, returning
+// an error if it ends up "Failed" or "Canceled". The initial PUT response
+// only means ARM accepted the request, not that the VHD has actually been
+// validated and registered as an image yet.
+func armWaitImageProvisioned(token, endpoint, provisioningState string) error {
+	for {
+		switch provisioningState {
+		case "Succeeded":
+			return nil
+		case "Failed", "Canceled":
+			return fmt.Errorf("image provisioning %s", provisioningState)
+		}
+
+		time.Sleep(15 * time.Second)
+
+		req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: %s", resp.Status, string(body))
+		}
+
+		var out struct {
+			Properties struct {
+				ProvisioningState string `json:"provisioningState"`
+			} `json:"properties"`
+		}
+		if err := json.Unmarshal(body, &out); err != nil {
+			return err
+		}
+		provisioningState = out.Properties.ProvisioningState
+	}
+}
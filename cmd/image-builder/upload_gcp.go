@@ -0,0 +1,446 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/osbuild/bootc-image-builder/bib/pkg/progress"
+)
+
+// gcpUploader uploads a raw disk image to a GCS bucket and registers it
+// as a Compute Engine Image. It authenticates as the service account
+// named by GOOGLE_APPLICATION_CREDENTIALS (the same file most gcloud/GCP
+// SDK tooling expects) via a hand-rolled OAuth2 JWT bearer flow, rather
+// than depending on the GCP SDK.
+type gcpUploader struct {
+	Bucket    string
+	Project   string
+	ImageName string
+}
+
+func (u *gcpUploader) Name() string {
+	return "gcp"
+}
+
+func (u *gcpUploader) Check(pbar progress.ProgressBar) error {
+	pbar.SetPulseMsgf("Checking GCP access")
+	_, err := gcpServiceAccountFromEnv()
+	return err
+}
+
+// Upload packages the raw disk image at imagePath as a "disk.raw"
+// tar.gz (the format Compute Engine's rawDisk image import expects),
+// uploads it to u.Bucket, then creates a Compute Engine Image named
+// u.ImageName in u.Project from it. It returns the new image's selfLink.
+func (u *gcpUploader) Upload(imagePath, arch string) (string, error) {
+	sa, err := gcpServiceAccountFromEnv()
+	if err != nil {
+		return "", err
+	}
+	token, err := gcpAccessToken(sa, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return "", fmt.Errorf("authenticate: %w", err)
+	}
+
+	packedPath, cleanup, err := gcpPackageRawDisk(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("package disk image: %w", err)
+	}
+	defer cleanup()
+
+	object := fmt.Sprintf("image-builder-%d.tar.gz", time.Now().UnixNano())
+	if _, err := gcsUpload(token, u.Bucket, object, packedPath); err != nil {
+		return "", fmt.Errorf("upload to gcs: %w", err)
+	}
+
+	selfLink, err := computeCreateImage(token, u.Project, u.ImageName, fmt.Sprintf("https://storage.googleapis.com/%s/%s", u.Bucket, object))
+	if err != nil {
+		return "", fmt.Errorf("create compute image: %w", err)
+	}
+	return selfLink, nil
+}
+
+func newGCPUploader(cmd *cobra.Command) (Uploader, error) {
+	bucket, err := cmd.Flags().GetString("gcp-bucket")
+	if err != nil {
+		return nil, err
+	}
+	project, err := cmd.Flags().GetString("gcp-project")
+	if err != nil {
+		return nil, err
+	}
+	imageName, err := cmd.Flags().GetString("gcp-image-name")
+	if err != nil {
+		return nil, err
+	}
+
+	required := []bool{bucket != "", project != "", imageName != ""}
+	if !anyTrue(required) {
+		return nil, nil
+	}
+	if !allTrue(required) {
+		return nil, &MissingUploadConfigError{Provider: "gcp"}
+	}
+
+	return &gcpUploader{Bucket: bucket, Project: project, ImageName: imageName}, nil
+}
+
+// gcpServiceAccount is the subset of a GCP service account JSON key file
+// needed to sign a JWT bearer assertion.
+type gcpServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+func gcpServiceAccountFromEnv() (*gcpServiceAccount, error) {
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		return nil, fmt.Errorf("GOOGLE_APPLICATION_CREDENTIALS must be set in the environment")
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read service account key: %w", err)
+	}
+	var sa gcpServiceAccount
+	if err := json.Unmarshal(buf, &sa); err != nil {
+		return nil, fmt.Errorf("parse service account key: %w", err)
+	}
+	if sa.ClientEmail == "" || sa.PrivateKey == "" {
+		return nil, fmt.Errorf("service account key missing client_email/private_key")
+	}
+	if sa.TokenURI == "" {
+		sa.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &sa, nil
+}
+
+// gcpAccessToken exchanges a signed JWT bearer assertion for an OAuth2
+// access token, per
+// https://developers.google.com/identity/protocols/oauth2/service-account#jwt-auth.
+func gcpAccessToken(sa *gcpServiceAccount, scope string) (string, error) {
+	key, err := gcpParsePrivateKey(sa.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	claims := map[string]interface{}{
+		"iss":   sa.ClientEmail,
+		"scope": scope,
+		"aud":   sa.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("sign jwt: %w", err)
+	}
+	assertion := unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	resp, err := http.PostForm(sa.TokenURI, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", resp.Status, string(body))
+	}
+
+	var out struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return "", err
+	}
+	if out.AccessToken == "" {
+		return "", fmt.Errorf("token response had no access_token")
+	}
+	return out.AccessToken, nil
+}
+
+func gcpParsePrivateKey(pemKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, fmt.Errorf("invalid private key: not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not RSA")
+	}
+	return rsaKey, nil
+}
+
+// gcpPackageRawDisk wraps the raw disk image at imagePath as a gzip-
+// compressed tar archive containing a single "disk.raw" entry, the
+// layout Compute Engine's rawDisk image import requires, and writes it
+// to a temporary file. The caller must invoke the returned cleanup func
+// to remove it once the upload is done.
+func gcpPackageRawDisk(imagePath string) (path string, cleanup func(), err error) {
+	src, err := os.Open(imagePath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer src.Close()
+
+	fi, err := src.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+
+	tmp, err := os.CreateTemp("", "image-builder-gcp-*.tar.gz")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+
+	gw := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(gw)
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name: "disk.raw",
+		Mode: 0o644,
+		Size: fi.Size(),
+	}); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	if _, err := io.Copy(tw, src); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	if err := tw.Close(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	if err := gw.Close(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	return tmp.Name(), cleanup, nil
+}
+
+// gcsUpload uploads the file at path to bucket/object via GCS's "simple"
+// upload API (a single PUT, no resumable session), and returns the
+// object's media link.
+func gcsUpload(token, bucket, object, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	endpoint := fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=media&name=%s", bucket, url.QueryEscape(object))
+	req, err := http.NewRequest(http.MethodPost, endpoint, f)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", resp.Status, string(body))
+	}
+
+	var out struct {
+		MediaLink string `json:"mediaLink"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return "", err
+	}
+	return out.MediaLink, nil
+}
+
+// computeCreateImage creates a Compute Engine Image in project from the
+// raw disk image at sourceURI (a "gs://"-less https storage.googleapis.com
+// URL), and returns the new image's selfLink.
+func computeCreateImage(token, project, imageName, sourceURI string) (string, error) {
+	endpoint := fmt.Sprintf("https://compute.googleapis.com/compute/v1/projects/%s/global/images", project)
+
+	body := map[string]interface{}{
+		"name": imageName,
+		"rawDisk": map[string]interface{}{
+			"source": sourceURI,
+		},
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", resp.Status, string(respBody))
+	}
+
+	// the insert call returns a long-running Operation, not the Image
+	// itself; its targetLink (once the operation completes) is the
+	// resulting image's selfLink.
+	var op struct {
+		Name       string `json:"name"`
+		TargetLink string `json:"targetLink"`
+		Error      *struct {
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(respBody, &op); err != nil {
+		return "", err
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		msgs := make([]string, len(op.Error.Errors))
+		for i, e := range op.Error.Errors {
+			msgs[i] = e.Message
+		}
+		return "", fmt.Errorf("%s", strings.Join(msgs, "; "))
+	}
+	if op.Name == "" {
+		return "", fmt.Errorf("images.insert response had no operation name")
+	}
+
+	return computeWaitGlobalOperation(token, project, op.Name, op.TargetLink)
+}
+
+// computeWaitGlobalOperation polls the global Compute Engine operation
+// named name until it reaches a terminal "DONE" status, returning an
+// error if the operation itself failed. images.insert's initial response
+// only means the operation was accepted, not that the image has actually
+// been created from its source disk yet.
+func computeWaitGlobalOperation(token, project, name, targetLink string) (string, error) {
+	endpoint := fmt.Sprintf("https://compute.googleapis.com/compute/v1/projects/%s/global/operations/%s", project, name)
+
+	for {
+		req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("%s: %s", resp.Status, string(body))
+		}
+
+		var out struct {
+			Status     string `json:"status"`
+			TargetLink string `json:"targetLink"`
+			Error      *struct {
+				Errors []struct {
+					Message string `json:"message"`
+				} `json:"errors"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(body, &out); err != nil {
+			return "", err
+		}
+
+		if out.Status == "DONE" {
+			if out.Error != nil && len(out.Error.Errors) > 0 {
+				msgs := make([]string, len(out.Error.Errors))
+				for i, e := range out.Error.Errors {
+					msgs[i] = e.Message
+				}
+				return "", fmt.Errorf("%s", strings.Join(msgs, "; "))
+			}
+			link := out.TargetLink
+			if link == "" {
+				link = targetLink
+			}
+			if link == "" {
+				return "", fmt.Errorf("images.insert operation finished without a targetLink")
+			}
+			return link, nil
+		}
+
+		time.Sleep(15 * time.Second)
+	}
+}